@@ -0,0 +1,238 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/spf13/afero"
+	"golang.org/x/term"
+
+	config "github.com/openpubkey/opkssh/commands/client-config"
+)
+
+// lastProviderFileName is where the chooser remembers which provider
+// alias was picked last time (and, per alias, the account it logged in
+// as), so a repeat login can default to the same provider instead of
+// asking every run.
+const lastProviderFileName = "last_provider"
+
+// lastProviderState is the JSON persisted to lastProviderFileName.
+// Accounts is only ever used to render a hint next to an alias in the
+// chooser; nothing in this file is trusted as credential material.
+type lastProviderState struct {
+	LastAlias string            `json:"last_alias"`
+	Accounts  map[string]string `json:"accounts,omitempty"`
+}
+
+// defaultLastProviderPath returns ~/.config/opkssh/last_provider.
+func defaultLastProviderPath() (string, error) {
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %w", err)
+	}
+	return filepath.Join(homePath, ".config", "opkssh", lastProviderFileName), nil
+}
+
+// loadLastProviderState reads the chooser's remembered state, treating a
+// missing or unparsable file as "nothing remembered yet" rather than an
+// error: the chooser is still usable without it.
+func loadLastProviderState(fs afero.Fs, path string) lastProviderState {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return lastProviderState{}
+	}
+	var state lastProviderState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return lastProviderState{}
+	}
+	return state
+}
+
+func saveLastProviderState(fs afero.Fs, path string, state lastProviderState) error {
+	if err := fs.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating config directory (%s): %w", filepath.Dir(path), err)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error marshalling last provider state: %w", err)
+	}
+	if err := afero.WriteFile(fs, path, data, 0600); err != nil {
+		return fmt.Errorf("error writing last provider file (%s): %w", path, err)
+	}
+	return nil
+}
+
+// isTerminal reports whether f is an interactive terminal rather than a
+// pipe, redirect, or /dev/null - the usual stand-in for stdin in a cron
+// job or service unit. A stat-mode check alone can't tell these apart:
+// /dev/null is itself a character device, same as a real tty, so this
+// asks the kernel directly via the terminal ioctl instead.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// runChooser prompts the user, on stdin/stdout, to pick one of chooser's
+// providers. Non-interactive invocations (CI, scripts, piped stdin) fail
+// fast instead of blocking on a prompt nobody can answer. It returns the
+// chosen provider's alias alongside the provider so Run can later record
+// an account hint for it via rememberChosenAccount.
+func (l *LoginCmd) runChooser(chooser *Chooser) (providers.OpenIdProvider, string, error) {
+	if !isTerminal(os.Stdin) {
+		return nil, "", fmt.Errorf("multiple providers are configured and no terminal is attached to choose one; set OPKSSH_DEFAULT or pass --provider-alias")
+	}
+	return l.chooseFrom(chooser, os.Stdin, os.Stdout)
+}
+
+// chooseFrom renders the numbered provider list to out, reads the user's
+// choice from in, and remembers it for next time. It is split out from
+// runChooser so tests can drive it with synthetic stdin/stdout without
+// needing a real terminal.
+func (l *LoginCmd) chooseFrom(chooser *Chooser, in io.Reader, out io.Writer) (providers.OpenIdProvider, string, error) {
+	if len(chooser.configs) == 0 {
+		return nil, "", fmt.Errorf("no providers to choose from")
+	}
+
+	lastProviderPath, err := defaultLastProviderPath()
+	if err != nil {
+		return nil, "", err
+	}
+	state := loadLastProviderState(l.fs(), lastProviderPath)
+
+	fmt.Fprintln(out, "Multiple providers are configured. Choose one:")
+	for i, cfg := range chooser.configs {
+		line := fmt.Sprintf("  %d) %s (%s)", i+1, cfg.Alias, cfg.Issuer)
+		if hint := state.Accounts[cfg.Alias]; hint != "" {
+			line += fmt.Sprintf(" [%s]", hint)
+		}
+		if cfg.Alias == state.LastAlias {
+			line += " (last used)"
+		}
+		fmt.Fprintln(out, line)
+	}
+	if state.LastAlias != "" {
+		fmt.Fprintf(out, "Enter a number [default: %s]: ", state.LastAlias)
+	} else {
+		fmt.Fprint(out, "Enter a number: ")
+	}
+
+	reader := bufio.NewReader(in)
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("error reading choice: %w", err)
+	}
+	choice := strings.TrimSpace(line)
+
+	selected, err := selectConfig(chooser.configs, choice, state.LastAlias)
+	if err != nil {
+		return nil, "", err
+	}
+
+	selected.OfflineAccess = selected.OfflineAccess || l.autoRefresh
+	selected.DeviceFlow = selected.DeviceFlow || l.deviceFlowArg
+	provider, err := selected.ToProvider(chooser.openBrowser)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Remembering the choice is a convenience, not a requirement for
+	// login to succeed - an unwritable config directory shouldn't abort
+	// an otherwise-successful authentication, so this is best effort.
+	state.LastAlias = selected.Alias
+	_ = saveLastProviderState(l.fs(), lastProviderPath, state)
+
+	return provider, selected.Alias, nil
+}
+
+// resolveRememberedProvider picks the provider the chooser would default
+// to from the last successful login (the same LastAlias chooseFrom reads)
+// without ever prompting. It exists for callers that cannot block on a
+// terminal - trySilentRefresh runs with no guarantee one is attached,
+// since it exists specifically to resume auto-refresh under a supervisor
+// that restarts opkssh with no TTY on stdin.
+func (l *LoginCmd) resolveRememberedProvider(chooser *Chooser) (providers.OpenIdProvider, error) {
+	lastProviderPath, err := defaultLastProviderPath()
+	if err != nil {
+		return nil, err
+	}
+	state := loadLastProviderState(l.fs(), lastProviderPath)
+	if state.LastAlias == "" {
+		return nil, fmt.Errorf("multiple providers are configured and none was used previously; set OPKSSH_DEFAULT or pass --provider-alias")
+	}
+
+	for _, cfg := range chooser.configs {
+		if cfg.Alias == state.LastAlias {
+			cfg.OfflineAccess = cfg.OfflineAccess || l.autoRefresh
+			cfg.DeviceFlow = cfg.DeviceFlow || l.deviceFlowArg
+			return cfg.ToProvider(chooser.openBrowser)
+		}
+	}
+	return nil, fmt.Errorf("remembered provider alias (%s) is no longer configured", state.LastAlias)
+}
+
+// rememberChosenAccount records the email claim from pkt as the account
+// hint shown next to alias the next time the chooser lists it.
+func (l *LoginCmd) rememberChosenAccount(alias string, pkt pktoken.PKToken) error {
+	claims, err := idTokenClaims(pkt)
+	if err != nil {
+		return err
+	}
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return nil
+	}
+
+	lastProviderPath, err := defaultLastProviderPath()
+	if err != nil {
+		return err
+	}
+	state := loadLastProviderState(l.fs(), lastProviderPath)
+	if state.Accounts == nil {
+		state.Accounts = make(map[string]string)
+	}
+	state.Accounts[alias] = email
+	return saveLastProviderState(l.fs(), lastProviderPath, state)
+}
+
+// selectConfig resolves the raw text the user typed into one of configs.
+// An empty choice falls back to defaultAlias (the last provider used), if
+// one is remembered; otherwise choice must be a 1-based index into
+// configs.
+func selectConfig(configs []*config.ProviderConfig, choice string, defaultAlias string) (*config.ProviderConfig, error) {
+	if choice == "" && defaultAlias != "" {
+		for _, cfg := range configs {
+			if cfg.Alias == defaultAlias {
+				return cfg, nil
+			}
+		}
+	}
+
+	idx, err := strconv.Atoi(choice)
+	if err != nil || idx < 1 || idx > len(configs) {
+		return nil, fmt.Errorf("invalid choice (%s), expected a number between 1 and %d", choice, len(configs))
+	}
+	return configs[idx-1], nil
+}
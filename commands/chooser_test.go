@@ -0,0 +1,120 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	config "github.com/openpubkey/opkssh/commands/client-config"
+)
+
+func chooserConfigs(t *testing.T) []*config.ProviderConfig {
+	config1, err := config.NewProviderConfigFromString(providerStr1, true)
+	require.NoError(t, err)
+	config2, err := config.NewProviderConfigFromString(providerStr2, true)
+	require.NoError(t, err)
+	return []*config.ProviderConfig{config1, config2}
+}
+
+func TestChooseFrom(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		lastAlias   string
+		wantIssuer  string
+		wantErr     bool
+		errorString string
+	}{
+		{
+			name:       "picks provider by number",
+			input:      "2\n",
+			wantIssuer: providerIssuer2,
+		},
+		{
+			name:       "blank input falls back to last used alias",
+			input:      "\n",
+			lastAlias:  providerAlias1,
+			wantIssuer: providerIssuer1,
+		},
+		{
+			name:        "out of range number",
+			input:       "9\n",
+			wantErr:     true,
+			errorString: "invalid choice",
+		},
+		{
+			name:        "non numeric input",
+			input:       "banana\n",
+			wantErr:     true,
+			errorString: "invalid choice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFs := afero.NewMemMapFs()
+			lastProviderPath, err := defaultLastProviderPath()
+			require.NoError(t, err)
+			if tt.lastAlias != "" {
+				require.NoError(t, saveLastProviderState(mockFs, lastProviderPath, lastProviderState{LastAlias: tt.lastAlias}))
+			}
+
+			loginCmd := LoginCmd{Fs: mockFs}
+			chooser := &Chooser{configs: chooserConfigs(t)}
+
+			var out bytes.Buffer
+			provider, alias, err := loginCmd.chooseFrom(chooser, strings.NewReader(tt.input), &out)
+			if tt.wantErr {
+				require.Error(t, err)
+				if tt.errorString != "" {
+					require.ErrorContains(t, err, tt.errorString)
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantIssuer, provider.Issuer())
+			require.NotEmpty(t, alias)
+			require.Contains(t, out.String(), providerAlias1)
+			require.Contains(t, out.String(), providerAlias2)
+		})
+	}
+}
+
+func TestRunChooserNonInteractive(t *testing.T) {
+	loginCmd := LoginCmd{Fs: afero.NewMemMapFs()}
+	_, _, err := loginCmd.runChooser(&Chooser{configs: chooserConfigs(t)})
+	require.Error(t, err)
+	require.ErrorContains(t, err, "no terminal is attached")
+}
+
+func TestRememberChosenAccount(t *testing.T) {
+	pkt, _, _ := Mocks(t)
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{Fs: mockFs}
+	require.NoError(t, loginCmd.rememberChosenAccount(providerAlias1, *pkt))
+
+	lastProviderPath, err := defaultLastProviderPath()
+	require.NoError(t, err)
+	state := loadLastProviderState(mockFs, lastProviderPath)
+	require.Equal(t, "arthur.aardvark@example.com", state.Accounts[providerAlias1])
+}
@@ -0,0 +1,49 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import "github.com/openpubkey/openpubkey/providers"
+
+// ProviderUnwrapper is implemented by wrappers around
+// providers.OpenIdProvider (PresetProviderOp is the only one) that hold
+// their embedded provider behind an interface field rather than a
+// concrete type. Embedding an interface only promotes that interface's
+// own methods, so a plain `provider.(providers.RefreshableOpenIdProvider)`
+// assertion can't see through such a wrapper even when the embedded
+// provider implements it; AsRefreshable unwraps one layer at a time - the
+// same pattern errors.Unwrap uses - to find it regardless of wrapper order.
+type ProviderUnwrapper interface {
+	Unwrap() providers.OpenIdProvider
+}
+
+// AsRefreshable finds the providers.RefreshableOpenIdProvider in
+// provider's wrapper chain, if any. providers.StandardOpRefreshable
+// implements it directly; a preset provider (OPKSSH_PROVIDERS entries
+// combining a realm-aware preset with offline access) wraps one in a
+// *PresetProviderOp, which AsRefreshable sees through via Unwrap.
+func AsRefreshable(provider providers.OpenIdProvider) (providers.RefreshableOpenIdProvider, bool) {
+	for {
+		if refresher, ok := provider.(providers.RefreshableOpenIdProvider); ok {
+			return refresher, true
+		}
+		unwrapper, ok := provider.(ProviderUnwrapper)
+		if !ok {
+			return nil, false
+		}
+		provider = unwrapper.Unwrap()
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discoveryCacheTTL bounds how long a fetched discovery document is
+// reused before opkssh re-fetches it, so a provider's endpoints can change
+// (e.g. after an upgrade) without requiring a restart.
+const discoveryCacheTTL = 10 * time.Minute
+
+// OIDCDiscoveryDocument is the subset of a provider's
+// .well-known/openid-configuration document opkssh relies on.
+type OIDCDiscoveryDocument struct {
+	Issuer                      string   `json:"issuer"`
+	AuthorizationEndpoint       string   `json:"authorization_endpoint"`
+	TokenEndpoint               string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string   `json:"device_authorization_endpoint"`
+	ScopesSupported             []string `json:"scopes_supported"`
+}
+
+// FetchOIDCDiscovery fetches and parses issuer's discovery document,
+// verifying that the document's own issuer claim matches what was
+// configured so a misconfigured or spoofed discovery URL can't silently
+// redirect opkssh to a different provider's endpoints.
+func FetchOIDCDiscovery(ctx context.Context, httpClient *http.Client, issuer string) (*OIDCDiscoveryDocument, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	discoveryURL := strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building discovery request: %w", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching discovery document from %s: %w", discoveryURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery request to %s returned status %d", discoveryURL, resp.StatusCode)
+	}
+
+	var doc OIDCDiscoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("error decoding discovery document from %s: %w", discoveryURL, err)
+	}
+
+	if doc.Issuer != issuer {
+		return nil, fmt.Errorf("discovered issuer (%s) does not match configured issuer (%s)", doc.Issuer, issuer)
+	}
+
+	return &doc, nil
+}
+
+type discoveryCacheEntry struct {
+	doc       *OIDCDiscoveryDocument
+	fetchedAt time.Time
+}
+
+var (
+	discoveryCacheMu sync.Mutex
+	discoveryCache   = map[string]discoveryCacheEntry{}
+)
+
+// CachedOIDCDiscovery wraps FetchOIDCDiscovery with a short-lived,
+// per-issuer cache: logging in against the same provider repeatedly (or
+// opkssh itself doing discovery more than once for the same login, e.g.
+// for device flow) shouldn't mean a fresh HTTP round trip every time.
+func CachedOIDCDiscovery(ctx context.Context, issuer string) (*OIDCDiscoveryDocument, error) {
+	discoveryCacheMu.Lock()
+	entry, ok := discoveryCache[issuer]
+	discoveryCacheMu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < discoveryCacheTTL {
+		return entry.doc, nil
+	}
+
+	doc, err := FetchOIDCDiscovery(ctx, nil, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	discoveryCacheMu.Lock()
+	discoveryCache[issuer] = discoveryCacheEntry{doc: doc, fetchedAt: time.Now()}
+	discoveryCacheMu.Unlock()
+
+	return doc, nil
+}
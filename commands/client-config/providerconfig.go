@@ -0,0 +1,281 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package config is opkssh's normalized representation of an OIDC
+// provider: ProviderConfig is built from either the comma-separated
+// OPKSSH_PROVIDERS format or a structured provider config file, and
+// ToProvider is what turns either one into the providers.OpenIdProvider
+// LoginCmd actually authenticates against.
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/openpubkey/openpubkey/providers"
+)
+
+// defaultRedirectURIs are the loopback callbacks opkssh listens on when a
+// provider config does not (or, in the comma-separated format, cannot)
+// specify its own redirect URIs.
+var defaultRedirectURIs = []string{
+	"http://localhost:3000/login-callback",
+	"http://localhost:10001/login-callback",
+	"http://localhost:11110/login-callback",
+}
+
+// defaultIssuedAtOffset is the clock-skew allowance we give OPs when
+// checking the "iat" claim.
+const defaultIssuedAtOffset = 60 * time.Second
+
+// ProviderConfig is opkssh's normalized representation of an OIDC provider,
+// regardless of whether it was supplied as a comma-separated string
+// (OPKSSH_PROVIDERS) or parsed from a config file.
+type ProviderConfig struct {
+	Alias        string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURIs []string
+
+	// OfflineAccess, when true, causes the "offline_access" scope to be
+	// requested so the OP returns a refresh token alongside the id token.
+	// It is never set from the comma-separated string format; callers that
+	// want silent renewal (e.g. LoginCmd's autoRefresh mode) set it after
+	// parsing.
+	OfflineAccess bool
+
+	// DeviceFlow, when true, has LoginCmd authenticate via the OAuth 2.0
+	// Device Authorization Grant (RFC 8628) instead of a browser
+	// redirect. It is the optional 6th field (5th when no alias is
+	// present) of the comma-separated format: a value of "true" or "1"
+	// enables it.
+	DeviceFlow bool
+
+	// GQSign enables GQ signatures on the id token. The comma-separated
+	// format has no field for it (it defaults to false there); it is only
+	// ever set via NewProviderConfigFromFile.
+	GQSign bool
+
+	// Preset names the realm-aware provider preset (e.g. "keycloak",
+	// "authentik") this config was built from, if any.
+	Preset string
+}
+
+// ProviderOptions is the JSON-safe subset of a provider's options that we
+// are willing to show the user (e.g. in the chooser) or write to the log.
+// ClientID and ClientSecret are deliberately excluded so this can never
+// leak a credential.
+type ProviderOptions struct {
+	Alias          string
+	Issuer         string
+	Scopes         []string
+	RedirectURIs   []string
+	GQSign         bool
+	OpenBrowser    bool
+	HttpClient     *http.Client
+	IssuedAtOffset time.Duration
+}
+
+// NewProviderConfigFromString parses a single entry of the
+// OPKSSH_PROVIDERS format. When hasAlias is true the entry is expected to
+// be prefixed with an alias field:
+//
+//	[alias,]issuer,client-id[,client-secret[,scopes[,device_flow]]]
+//
+// scopes is a space-separated list. client-secret and scopes may be left
+// empty or omitted (public clients typically have no secret). The issuer is not
+// validated here - that happens in ToProvider - so that a config can be
+// round-tripped (e.g. persisted, displayed) even before it is known to be
+// usable.
+//
+// A realm-aware preset uses a reserved "preset:" prefix on its first
+// field instead of an alias: preset:keycloak,host,realm,client-id,client-secret,scopes.
+// Field count alone can't disambiguate a preset from a plain alias entry
+// any more: both are a variable number of fields now that device_flow
+// added an optional 6th one to the alias form, so an alias happening to
+// be named "keycloak" with device_flow set would otherwise be
+// indistinguishable from a 6-field keycloak preset. The "preset:" prefix
+// is reserved - an alias may not be named "preset:<anything>".
+func NewProviderConfigFromString(configString string, hasAlias bool) (*ProviderConfig, error) {
+	fields := strings.Split(configString, ",")
+
+	if hasAlias && len(fields) > 0 && strings.HasPrefix(fields[0], presetFieldPrefix) {
+		preset := strings.TrimPrefix(fields[0], presetFieldPrefix)
+		return newPresetProviderConfig(preset, fields)
+	}
+
+	field := func(i int) string {
+		if i < len(fields) {
+			return fields[i]
+		}
+		return ""
+	}
+
+	var config ProviderConfig
+	if hasAlias {
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid provider config string, expected at least alias,issuer,client-id got (%s)", configString)
+		}
+		config.Alias = field(0)
+		config.Issuer = field(1)
+		config.ClientID = field(2)
+		config.ClientSecret = field(3)
+		config.Scopes = strings.Split(field(4), " ")
+		config.DeviceFlow = parseBoolField(field(5))
+	} else {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid provider config string, expected at least issuer,client-id got (%s)", configString)
+		}
+		config.Issuer = field(0)
+		config.ClientID = field(1)
+		config.ClientSecret = field(2)
+		config.Scopes = strings.Split(field(3), " ")
+		config.DeviceFlow = parseBoolField(field(4))
+	}
+
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("invalid provider client-ID value got (%s)", config.ClientID)
+	}
+
+	return &config, nil
+}
+
+// ToOptions builds the options shared by every provider implementation.
+// openBrowser controls whether the resulting provider should, when used
+// for an interactive login, open the user's browser automatically.
+func (c *ProviderConfig) ToOptions(openBrowser bool) *ProviderOptions {
+	scopes := c.Scopes
+	if c.OfflineAccess && !containsString(scopes, "offline_access") {
+		scopes = append(append([]string{}, scopes...), "offline_access")
+	}
+
+	redirectURIs := c.RedirectURIs
+	if len(redirectURIs) == 0 {
+		redirectURIs = defaultRedirectURIs
+	}
+
+	return &ProviderOptions{
+		Alias:          c.Alias,
+		Issuer:         c.Issuer,
+		Scopes:         scopes,
+		RedirectURIs:   redirectURIs,
+		GQSign:         c.GQSign,
+		OpenBrowser:    openBrowser,
+		HttpClient:     nil,
+		IssuedAtOffset: defaultIssuedAtOffset,
+	}
+}
+
+func parseBoolField(s string) bool {
+	return s == "true" || s == "1"
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ToProvider validates c and constructs the providers.OpenIdProvider it
+// describes. openBrowser is forwarded to the resulting provider's options
+// so interactive logins can open a browser while non-interactive flows
+// (device flow, refresh) never do.
+func (c *ProviderConfig) ToProvider(openBrowser bool) (providers.OpenIdProvider, error) {
+	if !strings.HasPrefix(c.Issuer, "https://") {
+		return nil, fmt.Errorf("invalid provider issuer value. Expected issuer to start with 'https://', got (%s)", c.Issuer)
+	}
+
+	// A device-flow login never drives a browser itself; opkssh prints a
+	// code for the user to enter on another device instead.
+	if c.DeviceFlow {
+		openBrowser = false
+	}
+
+	opts := c.ToOptions(openBrowser)
+	standardOpts := providers.GetDefaultStandardOpOptions(c.Issuer, c.ClientID)
+	standardOpts.ClientSecret = c.ClientSecret
+	standardOpts.Scopes = opts.Scopes
+	standardOpts.RedirectURIs = opts.RedirectURIs
+	standardOpts.GQSign = opts.GQSign
+	standardOpts.DeviceFlow = c.DeviceFlow
+	standardOpts.OpenBrowser = opts.OpenBrowser
+	standardOpts.HttpClient = opts.HttpClient
+	standardOpts.IssuedAtOffset = opts.IssuedAtOffset
+
+	// providers.NewStandardOpWithOptions hands back the
+	// BrowserOpenIdProvider interface, but its concrete type is always
+	// *providers.StandardOp; OfflineAccess needs the refresh-capable
+	// *providers.StandardOpRefreshable instead, which only differs by
+	// wrapping the same StandardOp.
+	bop := providers.NewStandardOpWithOptions(standardOpts)
+	var provider providers.OpenIdProvider = bop
+	if c.OfflineAccess {
+		standardOp, ok := bop.(*providers.StandardOp)
+		if !ok {
+			return nil, fmt.Errorf("internal error: unexpected standard provider implementation %T", bop)
+		}
+		provider = &providers.StandardOpRefreshable{StandardOp: *standardOp}
+	}
+
+	if c.Preset != "" {
+		doc, err := CachedOIDCDiscovery(context.Background(), c.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("error discovering %s realm endpoints: %w", c.Preset, err)
+		}
+		if err := validateScopesSupported(c.Scopes, doc); err != nil {
+			return nil, err
+		}
+		provider = &PresetProviderOp{OpenIdProvider: provider, Discovered: *doc}
+	}
+
+	return provider, nil
+}
+
+// validateScopesSupported checks that every scope the caller explicitly
+// configured for a preset's realm is one the realm actually advertises,
+// so a typo'd scope fails here with a clear error instead of deep inside
+// the OAuth code exchange. It deliberately checks only the caller's
+// configured scopes, not the offline_access ToOptions adds for
+// autoRefresh: scopes_supported is RECOMMENDED, not exhaustive, per the
+// OIDC discovery spec, and realms commonly support offline_access
+// without bothering to list it - failing autoRefresh logins over that
+// would do more harm than the check is worth. An empty ScopesSupported
+// list (the OP didn't advertise one at all) is likewise not treated as a
+// failure.
+func validateScopesSupported(scopes []string, doc *OIDCDiscoveryDocument) error {
+	if len(doc.ScopesSupported) == 0 {
+		return nil
+	}
+	for _, scope := range scopes {
+		// An omitted scopes field parses to a single empty string, which
+		// names no scope at all.
+		if scope == "" {
+			continue
+		}
+		if !containsString(doc.ScopesSupported, scope) {
+			return fmt.Errorf("provider does not support the %q scope (supported: %s)", scope, strings.Join(doc.ScopesSupported, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultProvidersFileName is where opkssh looks for a provider config
+// file when OPKSSH_PROVIDERS_FILE is not set.
+const DefaultProvidersFileName = "providers.yaml"
+
+// providerFileEntry is one provider as written in a provider config
+// file. Unlike the comma-separated OPKSSH_PROVIDERS format, every field
+// is named, so scopes and redirect URIs - which can't be expressed
+// cleanly as positional, comma-joined values - are just YAML/JSON lists.
+// yaml.v3 parses JSON documents fine (JSON is a YAML subset), so this one
+// struct covers both file formats the login command accepts.
+type providerFileEntry struct {
+	Alias         string   `yaml:"alias"`
+	Issuer        string   `yaml:"issuer"`
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	Scopes        []string `yaml:"scopes"`
+	RedirectURIs  []string `yaml:"redirect_uris"`
+	GQSign        bool     `yaml:"gq_sign"`
+	DeviceFlow    bool     `yaml:"device_flow"`
+	OfflineAccess bool     `yaml:"offline_access"`
+}
+
+type providerConfigFile struct {
+	Providers []providerFileEntry `yaml:"providers"`
+}
+
+// NewProviderConfigFromFile reads a YAML (or JSON) provider config file
+// at path, normalizing every entry into the same ProviderConfig shared
+// with the comma-separated string format. fs is taken explicitly, as
+// LoginCmd.Fs is, so this can be exercised against an in-memory
+// filesystem in tests.
+func NewProviderConfigFromFile(fs afero.Fs, path string) ([]*ProviderConfig, error) {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading provider config file (%s): %w", path, err)
+	}
+
+	var file providerConfigFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing provider config file (%s): %w", path, err)
+	}
+
+	configs := make([]*ProviderConfig, 0, len(file.Providers))
+	for _, entry := range file.Providers {
+		if entry.ClientID == "" {
+			return nil, fmt.Errorf("invalid provider client-ID value got (%s)", entry.ClientID)
+		}
+		configs = append(configs, &ProviderConfig{
+			Alias:         entry.Alias,
+			Issuer:        entry.Issuer,
+			ClientID:      entry.ClientID,
+			ClientSecret:  entry.ClientSecret,
+			Scopes:        entry.Scopes,
+			RedirectURIs:  entry.RedirectURIs,
+			GQSign:        entry.GQSign,
+			DeviceFlow:    entry.DeviceFlow,
+			OfflineAccess: entry.OfflineAccess,
+		})
+	}
+	return configs, nil
+}
+
+// DefaultProvidersFilePath returns ~/.config/opkssh/providers.yaml, or ""
+// if the user's home directory can't be determined.
+func DefaultProvidersFilePath() string {
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homePath, ".config", "opkssh", DefaultProvidersFileName)
+}
@@ -0,0 +1,80 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+const testProvidersYAML = `
+providers:
+  - alias: work
+    issuer: https://accounts.google.com
+    client_id: work-client-id
+    client_secret: work-client-secret
+    scopes: ["openid", "email", "profile"]
+    redirect_uris: ["http://localhost:22500/login-callback"]
+  - alias: personal
+    issuer: https://example.com/tokens-1/
+    client_id: personal-client-id
+    scopes: ["openid", "offline_access"]
+    device_flow: true
+  - alias: ci
+    issuer: https://auth.issuer/tokens-2/
+    client_id: ci-client-id
+    offline_access: true
+    gq_sign: true
+`
+
+func TestNewProviderConfigFromFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/home/user/.config/opkssh/providers.yaml"
+	require.NoError(t, afero.WriteFile(fs, path, []byte(testProvidersYAML), 0600))
+
+	configs, err := NewProviderConfigFromFile(fs, path)
+	require.NoError(t, err)
+	require.Len(t, configs, 3)
+
+	work := configs[0]
+	require.Equal(t, "work", work.Alias)
+	require.Equal(t, "https://accounts.google.com", work.Issuer)
+	require.Equal(t, []string{"openid", "email", "profile"}, work.Scopes)
+	require.Equal(t, []string{"http://localhost:22500/login-callback"}, work.RedirectURIs)
+	require.False(t, work.DeviceFlow)
+
+	personal := configs[1]
+	require.Equal(t, []string{"openid", "offline_access"}, personal.Scopes)
+	require.True(t, personal.DeviceFlow)
+	require.Empty(t, personal.RedirectURIs)
+
+	ci := configs[2]
+	require.True(t, ci.OfflineAccess)
+	require.True(t, ci.GQSign)
+}
+
+func TestNewProviderConfigFromFileMissingClientID(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/providers.yaml"
+	require.NoError(t, afero.WriteFile(fs, path, []byte("providers:\n  - alias: bad\n    issuer: https://example.com\n"), 0600))
+
+	_, err := NewProviderConfigFromFile(fs, path)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "invalid provider client-ID value")
+}
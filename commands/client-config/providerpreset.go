@@ -0,0 +1,91 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/openpubkey/openpubkey/providers"
+)
+
+const (
+	presetKeycloak  = "keycloak"
+	presetAuthentik = "authentik"
+
+	// presetFieldPrefix marks an OPKSSH_PROVIDERS entry's first field as
+	// naming a realm-aware preset rather than an alias, e.g.
+	// "preset:keycloak,host,realm,client-id". Reserved: an alias may not
+	// be named "preset:<anything>".
+	presetFieldPrefix = "preset:"
+)
+
+// newPresetProviderConfig builds the ProviderConfig for a realm-aware
+// preset entry: preset:<preset>,host,realm,client-id[,client-secret[,scopes]].
+// preset is fields[0] with the reserved "preset:" prefix already
+// stripped by the caller. It only constructs the issuer URL; ToProvider is
+// what actually resolves the realm's endpoints via discovery.
+func newPresetProviderConfig(preset string, fields []string) (*ProviderConfig, error) {
+	field := func(i int) string {
+		if i < len(fields) {
+			return fields[i]
+		}
+		return ""
+	}
+
+	host := strings.TrimRight(field(1), "/")
+	realm := field(2)
+	clientID := field(3)
+	if clientID == "" {
+		return nil, fmt.Errorf("invalid provider client-ID value got (%s)", clientID)
+	}
+
+	var issuer string
+	switch preset {
+	case presetKeycloak:
+		issuer = fmt.Sprintf("%s/realms/%s", host, realm)
+	case presetAuthentik:
+		issuer = fmt.Sprintf("%s/application/o/%s/", host, realm)
+	default:
+		return nil, fmt.Errorf("unknown provider preset (%s)", preset)
+	}
+
+	return &ProviderConfig{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: field(4),
+		Scopes:       strings.Split(field(5), " "),
+		Preset:       preset,
+	}, nil
+}
+
+// PresetProviderOp marks a provider built from a realm-aware preset and
+// retains the endpoints opkssh discovered for it, so both opkssh itself
+// and its tests can see what was wired through without repeating the
+// discovery round trip.
+type PresetProviderOp struct {
+	providers.OpenIdProvider
+	Discovered OIDCDiscoveryDocument
+}
+
+// Unwrap returns the provider PresetProviderOp wraps, so callers that need
+// to see through it (AsRefreshable, for a preset config combined with
+// offline access) can walk the wrapper chain regardless of what the
+// preset wraps.
+func (p *PresetProviderOp) Unwrap() providers.OpenIdProvider {
+	return p.OpenIdProvider
+}
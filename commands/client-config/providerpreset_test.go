@@ -0,0 +1,233 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+)
+
+// newMockRealmTLSServer is newMockRealmServer's TLS counterpart:
+// ToProvider rejects any issuer that isn't "https://", so exercising its
+// preset-discovery wiring end to end needs a server that looks like one.
+func newMockRealmTLSServer(t *testing.T, issuerPath string) *httptest.Server {
+	mux := http.NewServeMux()
+	var issuer string
+
+	mux.HandleFunc(issuerPath+"/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		doc := OIDCDiscoveryDocument{
+			Issuer:                      issuer,
+			AuthorizationEndpoint:       issuer + "/protocol/openid-connect/auth",
+			TokenEndpoint:               issuer + "/protocol/openid-connect/token",
+			DeviceAuthorizationEndpoint: issuer + "/protocol/openid-connect/auth/device",
+			ScopesSupported:             []string{"openid", "profile", "email"},
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(doc))
+	})
+
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+	issuer = server.URL + issuerPath
+	return server
+}
+
+// newMockRealmServer serves a discovery document for issuerPath (e.g.
+// "/realms/my-realm"), mimicking what a real Keycloak or Authentik
+// deployment would return.
+func newMockRealmServer(t *testing.T, issuerPath string) *httptest.Server {
+	mux := http.NewServeMux()
+	var issuer string
+
+	mux.HandleFunc(issuerPath+"/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		doc := OIDCDiscoveryDocument{
+			Issuer:                      issuer,
+			AuthorizationEndpoint:       issuer + "/protocol/openid-connect/auth",
+			TokenEndpoint:               issuer + "/protocol/openid-connect/token",
+			DeviceAuthorizationEndpoint: issuer + "/protocol/openid-connect/auth/device",
+			ScopesSupported:             []string{"openid", "profile", "email"},
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(doc))
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	issuer = server.URL + issuerPath
+	return server
+}
+
+func TestNewProviderConfigFromStringKeycloakPreset(t *testing.T) {
+	configStr := "preset:keycloak,https://sso.example.com,my-realm,client-id,,openid profile email"
+	cfg, err := NewProviderConfigFromString(configStr, true)
+	require.NoError(t, err)
+	require.Equal(t, "https://sso.example.com/realms/my-realm", cfg.Issuer)
+	require.Equal(t, "client-id", cfg.ClientID)
+	require.Equal(t, []string{"openid", "profile", "email"}, cfg.Scopes)
+	require.Equal(t, "keycloak", cfg.Preset)
+}
+
+func TestNewProviderConfigFromStringAuthentikPreset(t *testing.T) {
+	configStr := "preset:authentik,https://authentik.example.com,opkssh-slug,client-id,client-secret,openid"
+	cfg, err := NewProviderConfigFromString(configStr, true)
+	require.NoError(t, err)
+	require.Equal(t, "https://authentik.example.com/application/o/opkssh-slug/", cfg.Issuer)
+	require.Equal(t, "client-secret", cfg.ClientSecret)
+}
+
+// TestProviderConfigFromStringAuthentikAliasStillWorks pins down that a
+// plain alias entry that happens to be named "authentik" - as used
+// elsewhere in this package's tests - is never mistaken for the
+// "preset:authentik" preset form, regardless of field count.
+func TestProviderConfigFromStringAuthentikAliasStillWorks(t *testing.T) {
+	configStr := "authentik,https://authentik.io/application/o/opkssh/,client_id,,openid profile email"
+	cfg, err := NewProviderConfigFromString(configStr, true)
+	require.NoError(t, err)
+	require.Equal(t, "https://authentik.io/application/o/opkssh/", cfg.Issuer)
+	require.Empty(t, cfg.Preset)
+}
+
+// TestProviderConfigFromStringKeycloakAliasWithDeviceFlowStillWorks pins
+// down the case the "preset:" prefix exists to disambiguate: an alias
+// literally named "keycloak" that also sets the optional device_flow
+// field ends up with the same 6 fields a keycloak preset entry has, but
+// must still be parsed as a plain alias, not silently rerouted into
+// newPresetProviderConfig (which would misread client-id, secret and
+// scopes as host/realm/client-id and return a confusing error, or worse,
+// build the wrong issuer).
+func TestProviderConfigFromStringKeycloakAliasWithDeviceFlowStillWorks(t *testing.T) {
+	configStr := "keycloak,https://idp.example.com,my-client-id,,openid,true"
+	cfg, err := NewProviderConfigFromString(configStr, true)
+	require.NoError(t, err)
+	require.Equal(t, "https://idp.example.com", cfg.Issuer)
+	require.Equal(t, "my-client-id", cfg.ClientID)
+	require.True(t, cfg.DeviceFlow)
+	require.Empty(t, cfg.Preset)
+}
+
+// TestPresetDiscoveryWiring exercises the same discovery call ToProvider
+// makes for a preset config and confirms the resulting PresetProviderOp
+// carries the discovered endpoints through. It talks to a plain HTTP mock
+// server directly (ToProvider itself requires an https:// issuer, which a
+// local test server can't easily provide without a self-signed cert dance
+// that would obscure what's actually being tested here).
+func TestPresetDiscoveryWiring(t *testing.T) {
+	server := newMockRealmServer(t, "/realms/my-realm")
+	issuer := server.URL + "/realms/my-realm"
+
+	cfg := &ProviderConfig{Issuer: issuer, ClientID: "client-id", Preset: presetKeycloak}
+
+	doc, err := CachedOIDCDiscovery(context.Background(), cfg.Issuer)
+	require.NoError(t, err)
+
+	presetOp := &PresetProviderOp{Discovered: *doc}
+	require.Equal(t, issuer+"/protocol/openid-connect/token", presetOp.Discovered.TokenEndpoint)
+	require.Equal(t, issuer+"/protocol/openid-connect/auth/device", presetOp.Discovered.DeviceAuthorizationEndpoint)
+	require.Contains(t, presetOp.Discovered.ScopesSupported, "email")
+}
+
+// TestToProviderPresetWiring drives the actual code path this preset
+// feature depends on, ToProvider's Preset branch, and checks that the
+// resulting provider carries the discovered endpoints through as a
+// *PresetProviderOp. The discovery fetch inside it always goes through
+// http.DefaultClient, so the test swaps it for the TLS test server's
+// client (which trusts the server's self-signed cert) and restores it
+// afterwards.
+func TestToProviderPresetWiring(t *testing.T) {
+	server := newMockRealmTLSServer(t, "/realms/my-realm")
+	issuer := server.URL + "/realms/my-realm"
+
+	previousClient := http.DefaultClient
+	http.DefaultClient = server.Client()
+	t.Cleanup(func() { http.DefaultClient = previousClient })
+
+	cfg := &ProviderConfig{Issuer: issuer, ClientID: "client-id", Preset: presetKeycloak}
+	provider, err := cfg.ToProvider(false)
+	require.NoError(t, err)
+
+	presetOp, ok := provider.(*PresetProviderOp)
+	require.True(t, ok, "expected ToProvider to wrap a preset config in a *PresetProviderOp")
+	require.Equal(t, issuer+"/protocol/openid-connect/token", presetOp.Discovered.TokenEndpoint)
+	require.Equal(t, issuer+"/protocol/openid-connect/auth/device", presetOp.Discovered.DeviceAuthorizationEndpoint)
+	require.Contains(t, presetOp.Discovered.ScopesSupported, "email")
+}
+
+// TestToProviderPresetRejectsUnsupportedScope confirms the discovery
+// document ToProvider fetches for a preset config actually gates
+// construction: requesting an explicitly configured scope the realm
+// doesn't advertise in scopes_supported fails fast here rather than deep
+// inside the OAuth code exchange.
+func TestToProviderPresetRejectsUnsupportedScope(t *testing.T) {
+	server := newMockRealmTLSServer(t, "/realms/my-realm")
+	issuer := server.URL + "/realms/my-realm"
+
+	previousClient := http.DefaultClient
+	http.DefaultClient = server.Client()
+	t.Cleanup(func() { http.DefaultClient = previousClient })
+
+	cfg := &ProviderConfig{Issuer: issuer, ClientID: "client-id", Preset: presetKeycloak, Scopes: []string{"openid", "not-a-real-scope"}}
+	_, err := cfg.ToProvider(false)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "not-a-real-scope")
+}
+
+// TestToProviderPresetAllowsOfflineAccessNotAdvertised confirms that
+// requesting offline_access for autoRefresh never fails construction just
+// because a realm's discovery document omits it from scopes_supported:
+// that field is RECOMMENDED, not exhaustive, per the OIDC discovery spec,
+// and plenty of real realms support offline_access without bothering to
+// list it.
+func TestToProviderPresetAllowsOfflineAccessNotAdvertised(t *testing.T) {
+	server := newMockRealmTLSServer(t, "/realms/my-realm")
+	issuer := server.URL + "/realms/my-realm"
+
+	previousClient := http.DefaultClient
+	http.DefaultClient = server.Client()
+	t.Cleanup(func() { http.DefaultClient = previousClient })
+
+	cfg := &ProviderConfig{Issuer: issuer, ClientID: "client-id", Preset: presetKeycloak, OfflineAccess: true}
+	_, err := cfg.ToProvider(false)
+	require.NoError(t, err)
+}
+
+// TestToProviderPresetAndDeviceFlow pins down a realm preset combined with
+// --device (which sets DeviceFlow after parsing): ToProvider must still carry
+// DeviceFlow through to the *providers.StandardOp it wraps in a
+// *PresetProviderOp, or --device is silently ignored for preset providers.
+func TestToProviderPresetAndDeviceFlow(t *testing.T) {
+	server := newMockRealmTLSServer(t, "/realms/my-realm")
+	issuer := server.URL + "/realms/my-realm"
+
+	previousClient := http.DefaultClient
+	http.DefaultClient = server.Client()
+	t.Cleanup(func() { http.DefaultClient = previousClient })
+
+	cfg := &ProviderConfig{Issuer: issuer, ClientID: "client-id", Preset: presetKeycloak, DeviceFlow: true}
+	provider, err := cfg.ToProvider(true)
+	require.NoError(t, err)
+
+	presetOp, ok := provider.(*PresetProviderOp)
+	require.True(t, ok, "expected ToProvider to still wrap a preset+device-flow config in a *PresetProviderOp")
+
+	standardOp, ok := presetOp.Unwrap().(*providers.StandardOp)
+	require.True(t, ok, "expected the preset to wrap a *providers.StandardOp")
+	require.True(t, standardOp.DeviceFlow, "ToProvider should have set DeviceFlow on the wrapped provider")
+}
@@ -0,0 +1,531 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/jose"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+
+	config "github.com/openpubkey/opkssh/commands/client-config"
+)
+
+// defaultPrincipals are the SSH principals requested when the caller
+// (opkssh add, opkssh login) does not specify any.
+var defaultPrincipals = []string{"opkssh-user"}
+
+const (
+	defaultLogDir = "/var/log/opkssh"
+
+	sshKeyFilename = "id_ecdsa"
+
+	// refreshSuffix names the file, stored alongside the SSH key, that
+	// holds the encrypted OIDC refresh token used by autoRefresh mode.
+	refreshSuffix = ".opkssh.refresh"
+
+	// refreshFraction is how far into an ID token's lifetime we wait
+	// before renewing it: at 0.75 we refresh after 75% of (exp - iat)
+	// has elapsed, leaving slack for the new cert to land before the old
+	// one expires.
+	refreshFraction = 0.75
+
+	pktokenCertExtension = "openpubkey-pkt@openpubkey.org"
+)
+
+// LoginCmd implements `opkssh login`. Most fields are populated by
+// NewLogin from CLI flags, and NewLogin sets Fs to the OS filesystem; a
+// handful (verbosity, overrideProvider) are only ever set directly, by
+// tests or by main.go after flag parsing, and tests also replace Fs.
+type LoginCmd struct {
+	Fs afero.Fs
+
+	autoRefresh           bool
+	deviceFlowArg         bool
+	logDirArg             string
+	disableBrowserOpenArg bool
+	printIdTokenArg       bool
+	keyPathArg            string
+	providerArg           string
+	providerAliasArg      string
+	providersFileArg      string
+
+	// overrideProvider lets tests inject a mock provider instead of
+	// going through determineProvider.
+	overrideProvider *providers.OpenIdProvider
+
+	verbosity int
+}
+
+// NewLogin creates a LoginCmd ready to Run. autoRefresh enables silent
+// background cert renewal via an OIDC refresh token; logDir, if empty,
+// defaults to defaultLogDir. deviceFlow forces the OAuth 2.0 Device
+// Authorization Grant (RFC 8628) instead of a browser redirect.
+// providersFile, if non-empty, points at a structured YAML/JSON
+// provider-config file and takes precedence over OPKSSH_PROVIDERS_FILE
+// and the default ~/.config/opkssh/providers.yaml.
+func NewLogin(autoRefresh bool, logDir string, disableBrowserOpenArg bool, printIdTokenArg bool, providerArg string, keyPathArg string, providerAlias string, deviceFlow bool, providersFile string) *LoginCmd {
+	return &LoginCmd{
+		Fs:                    afero.NewOsFs(),
+		autoRefresh:           autoRefresh,
+		deviceFlowArg:         deviceFlow,
+		logDirArg:             logDir,
+		disableBrowserOpenArg: disableBrowserOpenArg,
+		printIdTokenArg:       printIdTokenArg,
+		providerArg:           providerArg,
+		keyPathArg:            keyPathArg,
+		providerAliasArg:      providerAlias,
+		providersFileArg:      providersFile,
+	}
+}
+
+// Chooser is returned by determineProvider when more than one provider is
+// configured and none has been picked as a default. OpList is a
+// credential-free summary of each candidate suitable for display; configs
+// and openBrowser are kept alongside it (unexported, so they never show up
+// in OpList's JSON) so runChooser can build a real provider once the user
+// has picked one.
+type Chooser struct {
+	OpList []config.ProviderOptions
+
+	configs     []*config.ProviderConfig
+	openBrowser bool
+}
+
+func (l *LoginCmd) Run(ctx context.Context) error {
+	if l.Fs == nil {
+		l.Fs = afero.NewOsFs()
+	}
+
+	logDir := l.logDirArg
+	if logDir == "" {
+		logDir = defaultLogDir
+	}
+	if err := l.Fs.MkdirAll(logDir, 0700); err != nil {
+		return fmt.Errorf("error creating log directory (%s): %w", logDir, err)
+	}
+	logPath := filepath.Join(logDir, "opkssh.log")
+	logFile, err := l.Fs.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening log file (%s): %w", logPath, err)
+	}
+	logger := log.New(logFile, "", log.LstdFlags)
+	logger.Printf("running login command with args: autoRefresh=%v logDir=%s disableBrowserOpen=%v provider=%s providerAlias=%s",
+		l.autoRefresh, logDir, l.disableBrowserOpenArg, l.providerArg, l.providerAliasArg)
+
+	if l.autoRefresh {
+		pkt, signer, provider, silentErr := l.trySilentRefresh(ctx, logger)
+		if silentErr == nil {
+			logger.Printf("auto-refresh: resumed silent renewal from a persisted refresh token")
+			l.autoRefreshLoop(ctx, logger, provider, signer, *pkt, defaultPrincipals)
+			return nil
+		}
+		logger.Printf("auto-refresh: could not resume from a persisted refresh token (%v), logging in interactively", silentErr)
+	}
+
+	provider, chooser, err := l.determineProvider()
+	if err != nil {
+		return fmt.Errorf("error determining provider: %w", err)
+	}
+	var chosenAlias string
+	if chooser != nil {
+		provider, chosenAlias, err = l.runChooser(chooser)
+		if err != nil {
+			return fmt.Errorf("error choosing provider: %w", err)
+		}
+	}
+
+	alg := jose.ES256
+	signer, err := util.GenKeyPair(alg)
+	if err != nil {
+		return fmt.Errorf("error generating signing key: %w", err)
+	}
+
+	// client.OpkClient never exposes the refresh token it receives from a
+	// successful Auth(), so an autoRefresh login that needs to persist one
+	// drives the OIDC exchange directly instead of going through OpkClient;
+	// a plain login has no reason to bypass OpkClient's tested codepath.
+	var pkt *pktoken.PKToken
+	var refreshToken []byte
+	if l.autoRefresh {
+		pkt, refreshToken, err = authAndCaptureRefreshToken(ctx, provider, signer, alg)
+	} else {
+		var opkClient *client.OpkClient
+		opkClient, err = client.New(provider, client.WithSigner(signer, alg))
+		if err == nil {
+			pkt, err = opkClient.Auth(ctx)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error logging in: %w", err)
+	}
+
+	if err := l.writeCredentials(logger, pkt, signer, defaultPrincipals); err != nil {
+		return err
+	}
+
+	if chosenAlias != "" {
+		if err := l.rememberChosenAccount(chosenAlias, *pkt); err != nil {
+			logger.Printf("error remembering account hint for provider %s: %v", chosenAlias, err)
+		}
+	}
+
+	if l.printIdTokenArg {
+		pktStr, err := PrettyIdToken(*pkt)
+		if err != nil {
+			return fmt.Errorf("error pretty printing id token: %w", err)
+		}
+		fmt.Println(pktStr)
+	}
+
+	if l.autoRefresh {
+		if len(refreshToken) == 0 {
+			logger.Printf("autoRefresh requested but provider %s did not return a refresh token (is offline_access enabled?)", provider.Issuer())
+			return nil
+		}
+		if err := l.persistRefreshState(signer, pkt, refreshToken); err != nil {
+			logger.Printf("error persisting refresh token, autoRefresh disabled for this session: %v", err)
+			return nil
+		}
+		// autoRefreshLoop only renews the cert while this process is
+		// alive, so opkssh login --auto-refresh is meant to be run
+		// as a long-lived foreground process (or under a supervisor
+		// that restarts it) rather than a one-shot command: Run
+		// blocks here until ctx is cancelled or the loop gives up.
+		l.autoRefreshLoop(ctx, logger, provider, signer, *pkt, defaultPrincipals)
+	}
+
+	return nil
+}
+
+// resolveKeyPath returns the SSH private key path opkssh reads and writes:
+// l.keyPathArg if the caller set one (e.g. --identity), otherwise the
+// conventional ~/.ssh/id_ecdsa. writeCredentials and refreshTokenPath both
+// go through this so the key and its refresh token always agree on where
+// the key actually lives.
+func (l *LoginCmd) resolveKeyPath() (string, error) {
+	if l.keyPathArg != "" {
+		return l.keyPathArg, nil
+	}
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %w", err)
+	}
+	return filepath.Join(homePath, ".ssh", sshKeyFilename), nil
+}
+
+// writeCredentials builds the SSH certificate for pkt and writes the
+// private key and certificate to resolveKeyPath's location (~/.ssh by
+// default), as OpenSSH expects them.
+func (l *LoginCmd) writeCredentials(logger *log.Logger, pkt *pktoken.PKToken, signer crypto.Signer, principals []string) error {
+	sshCertBytes, signKeyBytes, err := createSSHCert(pkt, signer, principals)
+	if err != nil {
+		return fmt.Errorf("error creating SSH cert: %w", err)
+	}
+
+	keyPath, err := l.resolveKeyPath()
+	if err != nil {
+		return err
+	}
+
+	if err := l.Fs.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return fmt.Errorf("error creating ssh directory: %w", err)
+	}
+	if err := atomicWriteFile(l.Fs, keyPath, signKeyBytes, 0600); err != nil {
+		return fmt.Errorf("error writing SSH private key: %w", err)
+	}
+
+	certDecoded, err := base64.StdEncoding.DecodeString(string(sshCertBytes))
+	if err != nil {
+		return fmt.Errorf("error decoding SSH cert: %w", err)
+	}
+	certPubKey, err := ssh.ParsePublicKey(certDecoded)
+	if err != nil {
+		return fmt.Errorf("error parsing SSH cert: %w", err)
+	}
+	certLine := fmt.Sprintf("%s %s", certPubKey.Type(), string(sshCertBytes))
+	// Written atomically (temp file + rename), not truncate-and-write: this
+	// is the file autoRefreshLoop rewrites on every renewal while sshd or
+	// ssh-agent may be reading it, and a reader should never be able to
+	// observe a half-written cert.
+	if err := atomicWriteFile(l.Fs, keyPath+"-cert.pub", []byte(certLine), 0644); err != nil {
+		return fmt.Errorf("error writing SSH cert: %w", err)
+	}
+
+	logger.Printf("wrote SSH key and cert to %s", keyPath)
+	return nil
+}
+
+// atomicWriteFile writes data to a temp file alongside path and renames it
+// into place, so a concurrent reader of path either sees the old contents
+// or the new ones in full, never a partial write.
+func atomicWriteFile(fs afero.Fs, path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	if err := afero.WriteFile(fs, tmpPath, data, perm); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error renaming %s to %s: %w", tmpPath, path, err)
+	}
+	return nil
+}
+
+// determineProvider figures out which OIDC provider to authenticate
+// against. Precedence, highest first:
+//
+//  1. l.providerArg - a single provider supplied directly (e.g. --provider)
+//  2. l.providerAliasArg - picks a provider out of the configured list
+//  3. OPKSSH_DEFAULT - same as above, read from the environment
+//  4. otherwise, every configured provider is returned as a Chooser so the
+//     caller can ask the user to pick one.
+func (l *LoginCmd) determineProvider() (providers.OpenIdProvider, *Chooser, error) {
+	if l.overrideProvider != nil {
+		return *l.overrideProvider, nil, nil
+	}
+
+	openBrowser := !l.disableBrowserOpenArg
+
+	if l.providerArg != "" {
+		cfg, err := config.NewProviderConfigFromString(l.providerArg, false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing --provider argument: %w", err)
+		}
+		cfg.OfflineAccess = cfg.OfflineAccess || l.autoRefresh
+		cfg.DeviceFlow = cfg.DeviceFlow || l.deviceFlowArg
+		provider, err := cfg.ToProvider(openBrowser)
+		if err != nil {
+			return nil, nil, err
+		}
+		return provider, nil, nil
+	}
+
+	configs, err := l.loadConfiguredProviders()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(configs) == 0 {
+		return nil, nil, fmt.Errorf("no providers configured, set OPKSSH_PROVIDERS or pass --provider")
+	}
+
+	alias := l.providerAliasArg
+	if alias == "" {
+		alias = os.Getenv("OPKSSH_DEFAULT")
+	}
+
+	if alias != "" {
+		for _, cfg := range configs {
+			if cfg.Alias == alias {
+				cfg.OfflineAccess = cfg.OfflineAccess || l.autoRefresh
+				cfg.DeviceFlow = cfg.DeviceFlow || l.deviceFlowArg
+				provider, err := cfg.ToProvider(openBrowser)
+				if err != nil {
+					return nil, nil, err
+				}
+				return provider, nil, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("no provider configured with alias (%s)", alias)
+	}
+
+	opList := make([]config.ProviderOptions, 0, len(configs))
+	for _, cfg := range configs {
+		opList = append(opList, *cfg.ToOptions(openBrowser))
+	}
+	return nil, &Chooser{OpList: opList, configs: configs, openBrowser: openBrowser}, nil
+}
+
+// fs returns the afero.Fs to use when determineProvider needs to look for
+// a provider config file, falling back to the real filesystem: tests
+// construct a LoginCmd without going through NewLogin or Run, so Fs may
+// not be set yet.
+func (l *LoginCmd) fs() afero.Fs {
+	if l.Fs == nil {
+		return afero.NewOsFs()
+	}
+	return l.Fs
+}
+
+// loadConfiguredProviders loads the configured providers, preferring a
+// structured provider config file (--providers-file, OPKSSH_PROVIDERS_FILE,
+// or ~/.config/opkssh/providers.yaml, in that order) over the legacy
+// semicolon-separated OPKSSH_PROVIDERS string, which is kept working for
+// backward compatibility. Both forms are normalized into ProviderConfig,
+// so every caller downstream is agnostic to which one was used.
+func (l *LoginCmd) loadConfiguredProviders() ([]*config.ProviderConfig, error) {
+	filePath := l.providersFileArg
+	if filePath == "" {
+		filePath = os.Getenv("OPKSSH_PROVIDERS_FILE")
+	}
+	if filePath == "" {
+		filePath = config.DefaultProvidersFilePath()
+	}
+	if filePath != "" {
+		if exists, err := afero.Exists(l.fs(), filePath); err == nil && exists {
+			return config.NewProviderConfigFromFile(l.fs(), filePath)
+		}
+	}
+
+	providersStr := os.Getenv("OPKSSH_PROVIDERS")
+	if providersStr == "" {
+		return nil, nil
+	}
+
+	var configs []*config.ProviderConfig
+	for _, entry := range strings.Split(providersStr, ";") {
+		cfg, err := config.NewProviderConfigFromString(entry, true)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing OPKSSH_PROVIDERS entry (%s): %w", entry, err)
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// createSSHCert builds an SSH user certificate, signed by signer itself,
+// whose only claim to validity is the embedded PK token: it carries no CA
+// trust of its own. The opkssh verifier extracts the pktoken extension and
+// checks it cryptographically against the identity provider instead of
+// checking a certificate chain.
+func createSSHCert(pkt *pktoken.PKToken, signer crypto.Signer, principals []string) ([]byte, []byte, error) {
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating ssh signer: %w", err)
+	}
+
+	pktJson, err := json.Marshal(pkt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshalling PK token: %w", err)
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             sshSigner.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "opkssh-generated-cert",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Unix()),
+		ValidBefore:     uint64(now.Add(24 * time.Hour).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":         "",
+				"permit-user-rc":     "",
+				pktokenCertExtension: string(pktJson),
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, sshSigner); err != nil {
+		return nil, nil, fmt.Errorf("error signing SSH cert: %w", err)
+	}
+
+	sshCertBytes := []byte(base64.StdEncoding.EncodeToString(cert.Marshal()))
+
+	pemBlock, err := ssh.MarshalPrivateKey(signer, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshalling SSH private key: %w", err)
+	}
+	signKeyBytes := pem.EncodeToMemory(pemBlock)
+
+	return sshCertBytes, signKeyBytes, nil
+}
+
+// loadPersistedSigner reads back the ECDSA private key a previous run
+// wrote via createSSHCert/writeCredentials, so a freshly started process
+// can reuse the same signer instead of generating a new one: the refresh
+// token persisted alongside it was encrypted with a key derived from that
+// exact signer (see refreshEncryptionKey) and can never be decrypted with
+// any other.
+func loadPersistedSigner(fs afero.Fs, keyPath string) (crypto.Signer, error) {
+	pemBytes, err := afero.ReadFile(fs, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading persisted SSH key: %w", err)
+	}
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing persisted SSH key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("persisted SSH key at %s is not a supported signer type", keyPath)
+	}
+	return signer, nil
+}
+
+// idTokenClaims decodes the (unverified - verification already happened
+// as part of building the PK token) claims out of the id token's JWT
+// payload segment.
+func idTokenClaims(pkt pktoken.PKToken) (map[string]any, error) {
+	parts := strings.Split(string(pkt.OpToken), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding id token payload: %w", err)
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("error unmarshalling id token claims: %w", err)
+	}
+	return claims, nil
+}
+
+// IdentityString renders the id token claims opkssh cares about in the
+// single line it prints/logs on successful login.
+func IdentityString(pkt pktoken.PKToken) (string, error) {
+	claims, err := idTokenClaims(pkt)
+	if err != nil {
+		return "", err
+	}
+	email, _ := claims["email"].(string)
+	sub, _ := claims["sub"].(string)
+	aud, _ := claims["aud"].(string)
+	iss, err := pkt.Issuer()
+	if err != nil {
+		return "", fmt.Errorf("error reading issuer from PK token: %w", err)
+	}
+	return fmt.Sprintf("Email, sub, issuer, audience: \n%s %s %s %s", email, sub, iss, aud), nil
+}
+
+// PrettyIdToken returns a human readable dump of the PK token's id token,
+// used by --print-id-token.
+func PrettyIdToken(pkt pktoken.PKToken) (string, error) {
+	claims, err := idTokenClaims(pkt)
+	if err != nil {
+		return "", err
+	}
+	prettyJson, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error formatting id token: %w", err)
+	}
+	return string(prettyJson), nil
+}
@@ -19,13 +19,14 @@ package commands
 import (
 	"context"
 	"crypto"
+	"encoding/base64"
 	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
 
-	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/jose"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/providers"
 	"github.com/openpubkey/openpubkey/util"
@@ -52,7 +53,7 @@ const providerStr3 = providerAlias3 + "," + providerArg3
 const allProvidersStr = providerStr1 + ";" + providerStr2 + ";" + providerStr3
 
 func Mocks(t *testing.T) (*pktoken.PKToken, crypto.Signer, providers.OpenIdProvider) {
-	alg := jwa.ES256
+	alg := jose.ES256
 	signer, err := util.GenKeyPair(alg)
 	require.NoError(t, err)
 
@@ -73,14 +74,6 @@ func Mocks(t *testing.T) (*pktoken.PKToken, crypto.Signer, providers.OpenIdProvi
 	return pkt, signer, op
 }
 
-func ProviderFromString(t *testing.T, providerString string) providers.OpenIdProvider {
-	providerConfig3, err := NewProviderConfigFromString(providerStr3, true)
-	require.NoError(t, err)
-	provider3, err := NewProviderFromConfig(providerConfig3, false)
-	require.NoError(t, err)
-	return provider3
-}
-
 func TestLoginCmd(t *testing.T) {
 	_, _, mockOp := Mocks(t)
 
@@ -158,7 +151,7 @@ func TestDetermineProvider(t *testing.T) {
 			wantIssuer:    "",
 			wantError:     false,
 			errorString:   "",
-			wantChooser:   `[{"Scopes":[""],"RedirectURIs":["http://localhost:3000/login-callback","http://localhost:10001/login-callback","http://localhost:11110/login-callback"],"GQSign":false,"OpenBrowser":false,"HttpClient":null,"IssuedAtOffset":60000000000}]`,
+			wantChooser:   `[{"Alias":"op1","Issuer":"https://example.com/tokens-1/","Scopes":[""],"RedirectURIs":["http://localhost:3000/login-callback","http://localhost:10001/login-callback","http://localhost:11110/login-callback"],"GQSign":false,"OpenBrowser":false,"HttpClient":null,"IssuedAtOffset":60000000000}]`,
 		},
 		{
 			name:          "Good path with env vars many providers and no default",
@@ -167,7 +160,7 @@ func TestDetermineProvider(t *testing.T) {
 			providerAlias: "",
 			wantIssuer:    "",
 			wantError:     false,
-			wantChooser:   `[{"Scopes":[""],"RedirectURIs":["http://localhost:3000/login-callback","http://localhost:10001/login-callback","http://localhost:11110/login-callback"],"GQSign":false,"OpenBrowser":false,"HttpClient":null,"IssuedAtOffset":60000000000},{"Scopes":[""],"RedirectURIs":["http://localhost:3000/login-callback","http://localhost:10001/login-callback","http://localhost:11110/login-callback"],"GQSign":false,"OpenBrowser":false,"HttpClient":null,"IssuedAtOffset":60000000000},{"Scopes":[""],"RedirectURIs":["http://localhost:3000/login-callback","http://localhost:10001/login-callback","http://localhost:11110/login-callback"],"GQSign":false,"OpenBrowser":false,"HttpClient":null,"IssuedAtOffset":60000000000}]`,
+			wantChooser:   `[{"Alias":"op1","Issuer":"https://example.com/tokens-1/","Scopes":[""],"RedirectURIs":["http://localhost:3000/login-callback","http://localhost:10001/login-callback","http://localhost:11110/login-callback"],"GQSign":false,"OpenBrowser":false,"HttpClient":null,"IssuedAtOffset":60000000000},{"Alias":"op2","Issuer":"https://auth.issuer/tokens-2/","Scopes":[""],"RedirectURIs":["http://localhost:3000/login-callback","http://localhost:10001/login-callback","http://localhost:11110/login-callback"],"GQSign":false,"OpenBrowser":false,"HttpClient":null,"IssuedAtOffset":60000000000},{"Alias":"op3","Issuer":"https://openidprovider.openidconnect/tokens-3/","Scopes":[""],"RedirectURIs":["http://localhost:3000/login-callback","http://localhost:10001/login-callback","http://localhost:11110/login-callback"],"GQSign":false,"OpenBrowser":false,"HttpClient":null,"IssuedAtOffset":60000000000}]`,
 		},
 		{
 			name:          "Good path with env vars many providers and providerAlias",
@@ -236,99 +229,6 @@ func TestDetermineProvider(t *testing.T) {
 	}
 }
 
-func TestProviderConfigFromString(t *testing.T) {
-
-	tests := []struct {
-		name           string
-		configString   string
-		hasAlias       bool
-		expectedIssuer string
-		wantError1     bool
-		errorString1   string
-		wantError2     bool
-		errorString2   string
-	}{
-		{
-			name:           "Good path with test providerStr3",
-			configString:   providerStr3,
-			hasAlias:       true,
-			expectedIssuer: providerIssuer3,
-		},
-		{
-			name:           "Good path with test authentik OP",
-			configString:   "authentik,https://authentik.io/application/o/opkssh/,client_id,,openid profile email",
-			hasAlias:       true,
-			expectedIssuer: "https://authentik.io/application/o/opkssh/",
-		},
-		{
-			name:           "Good path with test Google OP",
-			configString:   "https://accounts.google.com,206584157355-7cbe4s640tvm7naoludob4ut1emii7sf.apps.googleusercontent.com,NOT-aREAL_3a_GOOGLE-CLIENTSECRET",
-			hasAlias:       false,
-			expectedIssuer: "https://accounts.google.com",
-		},
-		{
-			name:           "Good path with test microsoft OP",
-			configString:   "https://login.microsoftonline.com/9188040d-6c67-4c5b-b112-36a304b66dad/v2.0,096ce0a3-5e72-4da8-9c86-12924b294a01",
-			hasAlias:       false,
-			expectedIssuer: "https://login.microsoftonline.com/9188040d-6c67-4c5b-b112-36a304b66dad/v2.0",
-		},
-		{
-			name:           "Good path with test microsoft OP",
-			configString:   "https://gitlab.com,8d8b7024572c7fd501f64374dec6bba37096783dfcd792b3988104be08cb6923",
-			hasAlias:       false,
-			expectedIssuer: "https://gitlab.com",
-		},
-		{
-			name:           "Good path with test hello OP",
-			configString:   "https://issuer.hello.coop,client-id,,openid email",
-			hasAlias:       false,
-			expectedIssuer: "https://issuer.hello.coop",
-		},
-		{
-			name:           "Alias set but no alias expected",
-			configString:   "exampleOp,https://token.example.com/,client_id,,openid profile email,",
-			hasAlias:       false,
-			expectedIssuer: "https://token.example.com/",
-			wantError2:     true,
-			errorString2:   "invalid provider issuer value. Expected issuer to start with 'https://'",
-		},
-		{
-			name:           "No alias set but alias expected",
-			configString:   "https://token.example.com/,client_id,,openid profile email,",
-			hasAlias:       true,
-			expectedIssuer: "https://token.example.com/",
-			wantError1:     true,
-			errorString1:   "invalid provider client-ID value got ()",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			providerConfig, err := NewProviderConfigFromString(tt.configString, tt.hasAlias)
-			if tt.wantError1 {
-				require.Error(t, err, "Expected error but got none")
-				if tt.errorString1 != "" {
-					require.ErrorContains(t, err, tt.errorString1, "Got a wrong error message")
-				}
-
-			} else {
-				require.NoError(t, err)
-				provider, err := NewProviderFromConfig(providerConfig, false)
-				if tt.wantError2 {
-					require.Error(t, err, "Expected error but got none")
-					if tt.errorString2 != "" {
-						require.ErrorContains(t, err, tt.errorString2, "Got a wrong error message")
-					}
-				} else {
-					require.NoError(t, err)
-					require.Equal(t, tt.expectedIssuer, provider.Issuer())
-				}
-			}
-		})
-	}
-
-}
-
 func TestNewLogin(t *testing.T) {
 	autoRefresh := false
 	logDir := "./testdata"
@@ -337,8 +237,10 @@ func TestNewLogin(t *testing.T) {
 	providerArg := ""
 	keyPathArg := ""
 	providerAlias := ""
+	deviceFlow := false
+	providersFile := ""
 
-	loginCmd := NewLogin(autoRefresh, logDir, disableBrowserOpenArg, printIdTokenArg, providerArg, keyPathArg, providerAlias)
+	loginCmd := NewLogin(autoRefresh, logDir, disableBrowserOpenArg, printIdTokenArg, providerArg, keyPathArg, providerAlias, deviceFlow, providersFile)
 	require.NotNil(t, loginCmd)
 }
 
@@ -352,7 +254,12 @@ func TestCreateSSHCert(t *testing.T) {
 	require.NotNil(t, signKeyBytes)
 
 	// Simple smoke test to verify we can parse the cert
-	certPubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte("certType" + " " + string(sshCertBytes)))
+	certDecoded, err := base64.StdEncoding.DecodeString(string(sshCertBytes))
+	require.NoError(t, err)
+	wantCertPubKey, err := ssh.ParsePublicKey(certDecoded)
+	require.NoError(t, err)
+
+	certPubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(wantCertPubKey.Type() + " " + string(sshCertBytes)))
 	require.NoError(t, err)
 	require.NotNil(t, certPubkey)
 }
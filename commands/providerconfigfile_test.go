@@ -0,0 +1,65 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+const testProvidersYAML = `
+providers:
+  - alias: work
+    issuer: https://accounts.google.com
+    client_id: work-client-id
+    client_secret: work-client-secret
+    scopes: ["openid", "email", "profile"]
+    redirect_uris: ["http://localhost:22500/login-callback"]
+  - alias: personal
+    issuer: https://example.com/tokens-1/
+    client_id: personal-client-id
+    scopes: ["openid", "offline_access"]
+    device_flow: true
+  - alias: ci
+    issuer: https://auth.issuer/tokens-2/
+    client_id: ci-client-id
+    offline_access: true
+    gq_sign: true
+`
+
+func TestLoginCmdPrefersProvidersFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/home/user/.config/opkssh/providers.yaml"
+	require.NoError(t, afero.WriteFile(fs, path, []byte(testProvidersYAML), 0600))
+	// "personal" exists only in the file, so resolving it proves the file
+	// won over OPKSSH_PROVIDERS.
+	t.Setenv("OPKSSH_PROVIDERS", allProvidersStr)
+
+	loginCmd := &LoginCmd{
+		Fs:                    fs,
+		providersFileArg:      path,
+		providerAliasArg:      "personal",
+		disableBrowserOpenArg: true,
+	}
+
+	provider, chooser, err := loginCmd.determineProvider()
+	require.NoError(t, err)
+	require.Nil(t, chooser)
+	require.Equal(t, "https://example.com/tokens-1/", provider.Issuer())
+}
@@ -0,0 +1,448 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/openpubkey/openpubkey/jose"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/hkdf"
+
+	config "github.com/openpubkey/opkssh/commands/client-config"
+)
+
+// authAndCaptureRefreshToken performs the same OIDC login
+// client.OpkClient.Auth would, but also returns the refresh token the OP
+// granted alongside the PK token: OpkClient keeps the refresh token it
+// receives entirely to itself (there is no exported getter for it, and
+// its own Refresh method only ever reuses it in place), so a login that
+// needs to persist the refresh token for silent renewal after this
+// process exits has to drive the exchange directly instead of through
+// OpkClient.
+func authAndCaptureRefreshToken(ctx context.Context, provider providers.OpenIdProvider, signer crypto.Signer, alg jose.KeyAlgorithm) (*pktoken.PKToken, []byte, error) {
+	jwkKey, err := jwk.PublicKeyOf(signer.Public())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error deriving public key for client instance claims: %w", err)
+	}
+	if err := jwkKey.Set(jwk.AlgorithmKey, alg); err != nil {
+		return nil, nil, fmt.Errorf("error setting client instance claims public key algorithm: %w", err)
+	}
+	cic, err := clientinstance.NewClaims(jwkKey, map[string]any{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error instantiating client instance claims: %w", err)
+	}
+
+	tokens, err := provider.RequestTokens(ctx, cic)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error requesting OIDC tokens from OpenID Provider: %w", err)
+	}
+
+	cicToken, err := cic.Sign(signer, alg, tokens.IDToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating cic token: %w", err)
+	}
+	pkt, err := pktoken.New(tokens.IDToken, cicToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating PK token: %w", err)
+	}
+
+	pktVerifier, err := verifier.New(provider)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pktVerifier.VerifyPKToken(ctx, pkt); err != nil {
+		return nil, nil, fmt.Errorf("error verifying PK token: %w", err)
+	}
+
+	return pkt, tokens.RefreshToken, nil
+}
+
+// refreshPKToken exchanges refreshToken at provider's token endpoint and
+// returns a copy of pkt with FreshIDToken updated to the new id token,
+// plus whatever refresh token the OP returned (some rotate it on every
+// use, some return the same one back). provider must implement
+// providers.RefreshableOpenIdProvider - callers find it via
+// config.AsRefreshable since a preset-wrapped provider doesn't satisfy
+// that interface directly.
+func refreshPKToken(ctx context.Context, provider providers.RefreshableOpenIdProvider, pkt *pktoken.PKToken, refreshToken []byte) (*pktoken.PKToken, []byte, error) {
+	tokens, err := provider.RefreshTokens(ctx, refreshToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error requesting refreshed tokens: %w", err)
+	}
+
+	refreshed, err := pkt.DeepCopy()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error copying PK token: %w", err)
+	}
+	refreshed.FreshIDToken = tokens.IDToken
+
+	newRefreshToken := tokens.RefreshToken
+	if len(newRefreshToken) == 0 {
+		newRefreshToken = refreshToken
+	}
+	return refreshed, newRefreshToken, nil
+}
+
+// autoRefreshLoop silently renews pkt's SSH certificate until ctx is
+// cancelled. It wakes up refreshFraction of the way through the id
+// token's lifetime (iat to exp), exchanges the refresh token at the OP's
+// token endpoint, rebuilds the PK token and rewrites the cert atomically.
+// If the exchange fails for any reason (revoked, expired, no network) it
+// logs why and falls back to a fresh interactive login (reusing whatever
+// provider selection Run itself would have made) instead of retrying the
+// refresh indefinitely; if that fallback also fails, it gives up and
+// returns.
+func (l *LoginCmd) autoRefreshLoop(ctx context.Context, logger *log.Logger, provider providers.OpenIdProvider, signer crypto.Signer, pkt pktoken.PKToken, principals []string) {
+	current := pkt
+	for {
+		sleepFor, err := nextRefreshDelay(current)
+		if err != nil {
+			logger.Printf("auto-refresh: could not determine id token expiry, stopping: %v", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sleepFor):
+		}
+
+		newPkt, newErr := l.refreshOnce(ctx, logger, provider, signer, principals)
+		if newErr == nil {
+			current = *newPkt
+			continue
+		}
+		logger.Printf("auto-refresh: %v, falling back to interactive login", newErr)
+
+		newPkt, newSigner, newProvider, err := l.reauthenticate(ctx, logger, principals)
+		if err != nil {
+			// reauthenticate can fail after already writing a fresh,
+			// valid cert (e.g. the provider stopped granting a refresh
+			// token) - that login succeeded, only silent renewal going
+			// forward did not, so this isn't phrased as an outright
+			// login failure.
+			logger.Printf("auto-refresh: could not resume silent renewal after interactive login, stopping: %v", err)
+			return
+		}
+
+		logger.Printf("auto-refresh: interactive login fallback succeeded, resuming silent renewal")
+		current = *newPkt
+		signer = newSigner
+		provider = newProvider
+	}
+}
+
+// refreshOnce does a single silent renewal: load the stored refresh
+// token, exchange it, and rewrite the SSH cert. Any failure along the way
+// is reported as a single error so the caller can decide to fall back to
+// an interactive login without needing to distinguish the failure modes.
+func (l *LoginCmd) refreshOnce(ctx context.Context, logger *log.Logger, provider providers.OpenIdProvider, signer crypto.Signer, principals []string) (*pktoken.PKToken, error) {
+	refresher, ok := config.AsRefreshable(provider)
+	if !ok {
+		return nil, fmt.Errorf("provider %s is not refresh-capable", provider.Issuer())
+	}
+
+	pkt, refreshToken, err := l.loadRefreshState(signer)
+	if err != nil {
+		return nil, fmt.Errorf("could not load refresh token: %w", err)
+	}
+
+	newPkt, newRefreshToken, err := refreshPKToken(ctx, refresher, pkt, refreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("token refresh failed: %w", err)
+	}
+
+	if err := l.writeCredentials(logger, newPkt, signer, principals); err != nil {
+		return nil, fmt.Errorf("failed to rewrite SSH cert: %w", err)
+	}
+
+	if err := l.persistRefreshState(signer, newPkt, newRefreshToken); err != nil {
+		logger.Printf("auto-refresh: failed to persist rotated refresh token: %v", err)
+	}
+
+	logger.Printf("auto-refresh: renewed SSH cert silently")
+	return newPkt, nil
+}
+
+// trySilentRefresh attempts to resume auto-refresh without any interactive
+// login: it loads the SSH key a previous --auto-refresh run persisted at
+// l.resolveKeyPath(), then does the same single renewal refreshOnce does
+// for an already-running process. This is what lets --auto-refresh
+// survive a supervisor restart instead of forcing a fresh interactive
+// login every time the process comes back up; if no persisted key
+// exists, or the renewal fails for any reason (no persisted token,
+// revoked, expired), the caller falls back to a normal interactive login.
+func (l *LoginCmd) trySilentRefresh(ctx context.Context, logger *log.Logger) (*pktoken.PKToken, crypto.Signer, providers.OpenIdProvider, error) {
+	keyPath, err := l.resolveKeyPath()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	signer, err := loadPersistedSigner(l.Fs, keyPath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("no persisted SSH key: %w", err)
+	}
+
+	provider, chooser, err := l.determineProvider()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error determining provider: %w", err)
+	}
+	if chooser != nil {
+		// Never prompt here: trySilentRefresh exists specifically to
+		// resume under a supervisor restart with no TTY attached, so it
+		// falls back to whichever provider the persisted refresh token
+		// actually belongs to (the one chooseFrom last remembered)
+		// instead of blocking like the interactive login path does.
+		provider, err = l.resolveRememberedProvider(chooser)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error choosing provider: %w", err)
+		}
+	}
+	if _, ok := config.AsRefreshable(provider); !ok {
+		return nil, nil, nil, fmt.Errorf("provider %s is not refresh-capable", provider.Issuer())
+	}
+
+	pkt, err := l.refreshOnce(ctx, logger, provider, signer, defaultPrincipals)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return pkt, signer, provider, nil
+}
+
+// reauthenticate re-runs the same provider-selection and login flow Run
+// does, for when auto-refresh can no longer silently renew the cert (the
+// refresh token was revoked, expired, or never persisted). It is the
+// "interactive login" autoRefreshLoop falls back to: if the selected
+// provider doesn't open a browser itself (e.g. device flow), logging in
+// again means prompting the user the same way a fresh `opkssh login`
+// would.
+func (l *LoginCmd) reauthenticate(ctx context.Context, logger *log.Logger, principals []string) (*pktoken.PKToken, crypto.Signer, providers.OpenIdProvider, error) {
+	provider, chooser, err := l.determineProvider()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error determining provider: %w", err)
+	}
+	if chooser != nil {
+		provider, _, err = l.runChooser(chooser)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error choosing provider: %w", err)
+		}
+	}
+
+	alg := jose.ES256
+	signer, err := util.GenKeyPair(alg)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error generating signing key: %w", err)
+	}
+
+	pkt, refreshToken, err := authAndCaptureRefreshToken(ctx, provider, signer, alg)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error logging in: %w", err)
+	}
+
+	if err := l.writeCredentials(logger, pkt, signer, principals); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(refreshToken) == 0 {
+		return nil, nil, nil, fmt.Errorf("provider %s did not return a refresh token (is offline_access enabled?)", provider.Issuer())
+	}
+	if err := l.persistRefreshState(signer, pkt, refreshToken); err != nil {
+		return nil, nil, nil, fmt.Errorf("error persisting refresh token: %w", err)
+	}
+
+	return pkt, signer, provider, nil
+}
+
+// nextRefreshDelay looks at the "iat"/"exp" claims of pkt's newest id
+// token (FreshIDToken once a refresh has set it, otherwise OpToken) and
+// returns how long to wait before renewing: refreshFraction of the way
+// between issuance and expiry.
+func nextRefreshDelay(pkt pktoken.PKToken) (time.Duration, error) {
+	idt := pkt
+	if len(pkt.FreshIDToken) > 0 {
+		idt = pktoken.PKToken{OpToken: pkt.FreshIDToken}
+	}
+	claims, err := idTokenClaims(idt)
+	if err != nil {
+		return 0, err
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("id token missing iat claim")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("id token missing exp claim")
+	}
+
+	issuedAt := time.Unix(int64(iat), 0)
+	expiresAt := time.Unix(int64(exp), 0)
+	lifetime := expiresAt.Sub(issuedAt)
+	refreshAt := issuedAt.Add(time.Duration(float64(lifetime) * refreshFraction))
+
+	delay := time.Until(refreshAt)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, nil
+}
+
+// refreshTokenPath is where the encrypted refresh state is stored,
+// alongside (never instead of) the SSH private key it belongs to. It
+// shares resolveKeyPath with writeCredentials so the two never disagree
+// about where that key actually lives.
+func (l *LoginCmd) refreshTokenPath() (string, error) {
+	keyPath, err := l.resolveKeyPath()
+	if err != nil {
+		return "", err
+	}
+	return keyPath + refreshSuffix, nil
+}
+
+// persistedRefreshState is what actually gets encrypted and written to
+// refreshTokenPath: client.OpkClient.Refresh can only renew a PK token it
+// already holds in memory from a prior Auth() in the same process, so
+// resuming silent renewal after this process restarts means
+// reconstructing that PK token ourselves. pkt's OpToken and CicToken
+// never change across a refresh (only FreshIDToken does), so persisting
+// the PK token once alongside the refresh token, here, is enough to
+// rebuild it on every subsequent renewal.
+type persistedRefreshState struct {
+	RefreshToken []byte `json:"refresh_token"`
+	PKToken      []byte `json:"pk_token"`
+}
+
+// persistRefreshState writes refreshToken and pkt to disk encrypted at
+// rest. The encryption key is derived from the SSH signing key itself via
+// HKDF, so the refresh state is no more exposed than the private key file
+// next to it, and opkssh does not need to manage a second secret.
+func (l *LoginCmd) persistRefreshState(signer crypto.Signer, pkt *pktoken.PKToken, refreshToken []byte) error {
+	pktJson, err := pkt.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("error marshalling PK token: %w", err)
+	}
+	plaintext, err := json.Marshal(persistedRefreshState{RefreshToken: refreshToken, PKToken: pktJson})
+	if err != nil {
+		return fmt.Errorf("error marshalling refresh state: %w", err)
+	}
+
+	key, err := refreshEncryptionKey(signer)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("error initializing cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("error initializing AEAD: %w", err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %w", err)
+	}
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+
+	tokenPath, err := l.refreshTokenPath()
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(l.Fs, tokenPath, ciphertext, 0600)
+}
+
+// loadRefreshState reads back and decrypts the refresh token and PK token
+// a previous run persisted via persistRefreshState.
+func (l *LoginCmd) loadRefreshState(signer crypto.Signer) (*pktoken.PKToken, []byte, error) {
+	tokenPath, err := l.refreshTokenPath()
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err := afero.ReadFile(l.Fs, tokenPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading refresh token: %w", err)
+	}
+
+	key, err := refreshEncryptionKey(signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error initializing cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error initializing AEAD: %w", err)
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, nil, fmt.Errorf("refresh token file is corrupt")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decrypting refresh token: %w", err)
+	}
+
+	var state persistedRefreshState
+	if err := json.Unmarshal(plaintext, &state); err != nil {
+		return nil, nil, fmt.Errorf("error unmarshalling refresh state: %w", err)
+	}
+	if len(state.PKToken) == 0 {
+		return nil, nil, fmt.Errorf("no PK token persisted alongside refresh token")
+	}
+	var pkt pktoken.PKToken
+	if err := json.Unmarshal(state.PKToken, &pkt); err != nil {
+		return nil, nil, fmt.Errorf("error unmarshalling persisted PK token: %w", err)
+	}
+	return &pkt, state.RefreshToken, nil
+}
+
+// refreshEncryptionKey derives a symmetric key for the refresh token file
+// from the ECDSA signing key already protected by ~/.ssh permissions.
+func refreshEncryptionKey(signer crypto.Signer) ([]byte, error) {
+	ecdsaKey, ok := signer.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("auto-refresh requires an ECDSA signing key")
+	}
+
+	kdf := hkdf.New(sha256.New, ecdsaKey.D.Bytes(), nil, []byte("opkssh-refresh-token-v1"))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, fmt.Errorf("error deriving refresh token key: %w", err)
+	}
+	return key, nil
+}
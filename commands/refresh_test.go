@@ -0,0 +1,244 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// syntheticPKToken builds a PKToken whose id token carries the given
+// iat/exp claims and nothing else, so nextRefreshDelay can be exercised
+// without driving a real OP through a full login.
+func syntheticPKToken(iat, exp int64) pktoken.PKToken {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"iat":%d,"exp":%d}`, iat, exp)))
+	return pktoken.PKToken{OpToken: []byte(header + "." + payload + ".sig")}
+}
+
+func TestNextRefreshDelay(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		iat       time.Time
+		exp       time.Time
+		wantZero  bool
+		wantAbout time.Duration
+	}{
+		{
+			name:      "freshly issued hour-long token refreshes at 75% of its lifetime",
+			iat:       now,
+			exp:       now.Add(time.Hour),
+			wantAbout: 45 * time.Minute,
+		},
+		{
+			name:     "already past the refresh point",
+			iat:      now.Add(-time.Hour),
+			exp:      now.Add(-time.Minute),
+			wantZero: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := syntheticPKToken(tt.iat.Unix(), tt.exp.Unix())
+			delay, err := nextRefreshDelay(pkt)
+			require.NoError(t, err)
+
+			if tt.wantZero {
+				require.Zero(t, delay)
+				return
+			}
+			require.InDelta(t, tt.wantAbout.Seconds(), delay.Seconds(), 5)
+		})
+	}
+}
+
+func TestNextRefreshDelayMissingClaims(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{}`))
+	pkt := pktoken.PKToken{OpToken: []byte(header + "." + payload + ".sig")}
+
+	_, err := nextRefreshDelay(pkt)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "iat claim")
+}
+
+func TestPersistAndLoadRefreshState(t *testing.T) {
+	pkt, signer, _ := Mocks(t)
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := &LoginCmd{Fs: mockFs}
+
+	refreshToken := []byte("test-refresh-token-value")
+	require.NoError(t, loginCmd.persistRefreshState(signer, pkt, refreshToken))
+
+	gotPkt, gotToken, err := loginCmd.loadRefreshState(signer)
+	require.NoError(t, err)
+	require.Equal(t, refreshToken, gotToken)
+	require.Equal(t, pkt.OpToken, gotPkt.OpToken)
+}
+
+func TestLoadRefreshStateMissingFile(t *testing.T) {
+	_, signer, _ := Mocks(t)
+
+	loginCmd := &LoginCmd{Fs: afero.NewMemMapFs()}
+	_, _, err := loginCmd.loadRefreshState(signer)
+	require.Error(t, err)
+}
+
+// TestRefreshTokenPathMatchesKeyPath pins down that refreshTokenPath
+// agrees with writeCredentials about where the SSH key lives, both when
+// keyPathArg is set and when it falls back to the ~/.ssh default: a
+// refresh token stored next to the wrong key path is as good as lost.
+func TestRefreshTokenPathMatchesKeyPath(t *testing.T) {
+	t.Run("custom keyPathArg", func(t *testing.T) {
+		loginCmd := &LoginCmd{Fs: afero.NewMemMapFs(), keyPathArg: "/custom/path/id_ecdsa"}
+		got, err := loginCmd.refreshTokenPath()
+		require.NoError(t, err)
+		require.Equal(t, "/custom/path/id_ecdsa"+refreshSuffix, got)
+	})
+
+	t.Run("default key path", func(t *testing.T) {
+		homePath, err := os.UserHomeDir()
+		require.NoError(t, err)
+
+		loginCmd := &LoginCmd{Fs: afero.NewMemMapFs()}
+		got, err := loginCmd.refreshTokenPath()
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(homePath, ".ssh", sshKeyFilename)+refreshSuffix, got)
+	})
+}
+
+// TestTrySilentRefreshNoPersistedKey confirms Run's auto-refresh fast path
+// fails cleanly (so Run falls back to an interactive login) when no SSH
+// key has ever been persisted, e.g. the very first invocation.
+func TestTrySilentRefreshNoPersistedKey(t *testing.T) {
+	loginCmd := &LoginCmd{Fs: afero.NewMemMapFs()}
+	_, _, _, err := loginCmd.trySilentRefresh(context.Background(), log.New(&bytes.Buffer{}, "", 0))
+	require.Error(t, err)
+	require.ErrorContains(t, err, "no persisted SSH key")
+}
+
+// TestTrySilentRefreshNoPersistedToken confirms that a persisted key with
+// no refresh token alongside it (e.g. a previous login without
+// --auto-refresh) also fails cleanly rather than attempting a refresh
+// with no token.
+func TestTrySilentRefreshNoPersistedToken(t *testing.T) {
+	pkt, signer, mockOp := Mocks(t)
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := &LoginCmd{Fs: mockFs}
+
+	keyPath, err := loginCmd.resolveKeyPath()
+	require.NoError(t, err)
+	_, signKeyBytes, err := createSSHCert(pkt, signer, defaultPrincipals)
+	require.NoError(t, err)
+	require.NoError(t, mockFs.MkdirAll(filepath.Dir(keyPath), 0700))
+	require.NoError(t, afero.WriteFile(mockFs, keyPath, signKeyBytes, 0600))
+
+	var provider providers.OpenIdProvider = mockOp
+	loginCmd.overrideProvider = &provider
+
+	_, _, _, err = loginCmd.trySilentRefresh(context.Background(), log.New(&bytes.Buffer{}, "", 0))
+	require.Error(t, err)
+	require.ErrorContains(t, err, "could not load refresh token")
+}
+
+// TestAutoRefreshLoopFallsBackToInteractiveLogin exercises an
+// expiry+refresh cycle using the mock provider: no refresh state has been
+// persisted, so the first wake-up fails the silent refresh, and
+// autoRefreshLoop must fall back to a fresh interactive login through
+// reauthenticate rather than just giving up silently.
+func TestAutoRefreshLoopFallsBackToInteractiveLogin(t *testing.T) {
+	_, signer, mockOp := Mocks(t)
+
+	var provider providers.OpenIdProvider = mockOp
+	loginCmd := &LoginCmd{
+		Fs:                    afero.NewMemMapFs(),
+		disableBrowserOpenArg: true,
+		overrideProvider:      &provider,
+	}
+
+	var logBuf bytes.Buffer
+	logger := log.New(&logBuf, "", 0)
+
+	// Already-expired so autoRefreshLoop wakes up immediately instead of
+	// waiting out a real refreshFraction-scaled delay. reauthenticate
+	// succeeds against the mock provider, so the loop keeps running
+	// (silent renewal resumed) rather than returning on its own; bound it
+	// with a short-lived ctx instead of letting it sleep out the freshly
+	// issued token's real lifetime.
+	expired := syntheticPKToken(time.Now().Add(-time.Hour).Unix(), time.Now().Add(-time.Minute).Unix())
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	loginCmd.autoRefreshLoop(ctx, logger, provider, signer, expired, defaultPrincipals)
+
+	require.Contains(t, logBuf.String(), "falling back to interactive login")
+	// reauthenticate re-runs a full login against the mock provider, which
+	// does report a refresh token, so the fallback succeeds and silent
+	// renewal resumes rather than giving up.
+	require.Contains(t, logBuf.String(), "interactive login fallback succeeded")
+}
+
+// TestRefreshOnceRenewsCertAndRotatesToken exercises the success path
+// autoRefreshLoop depends on for silent renewal: refreshOnce actually
+// calling the provider's RefreshTokens, rewriting the SSH cert with the
+// renewed PK token, and persisting the rotated refresh token the provider
+// reports afterwards.
+func TestRefreshOnceRenewsCertAndRotatesToken(t *testing.T) {
+	pkt, signer, mockOp := Mocks(t)
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := &LoginCmd{Fs: mockFs}
+	require.NoError(t, loginCmd.persistRefreshState(signer, pkt, []byte("initial-refresh-token")))
+
+	var logBuf bytes.Buffer
+	logger := log.New(&logBuf, "", 0)
+
+	newPkt, err := loginCmd.refreshOnce(context.Background(), logger, mockOp, signer, defaultPrincipals)
+	require.NoError(t, err)
+	require.NotNil(t, newPkt)
+	require.Equal(t, pkt.OpToken, newPkt.OpToken)
+	require.NotEmpty(t, newPkt.FreshIDToken)
+
+	require.Contains(t, logBuf.String(), "renewed SSH cert silently")
+
+	keyPath, err := loginCmd.resolveKeyPath()
+	require.NoError(t, err)
+	certBytes, err := afero.ReadFile(mockFs, keyPath+"-cert.pub")
+	require.NoError(t, err)
+	require.NotEmpty(t, certBytes)
+
+	_, gotToken, err := loginCmd.loadRefreshState(signer)
+	require.NoError(t, err)
+	require.Equal(t, []byte("mock-refresh-token"), gotToken)
+}